@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+)
+
+var (
+	keepAlive       = flag.Bool("keepalive", true, "enable TCP keepalive on accepted sockets and on sockets dialed in TCP mode")
+	keepAlivePeriod = flag.Duration("keepalive-period", 30*time.Second, "TCP keepalive probe interval, used when -keepalive is set")
+	noDelay         = flag.Bool("nodelay", true, "disable Nagle's algorithm (TCP_NODELAY) on accepted sockets and on sockets dialed in TCP mode")
+	lingerZero      = flag.Bool("linger-zero", false, "RST the 'a' socket instead of lingering in TIME_WAIT when the client half-closes first")
+)
+
+// configureConn applies the -keepalive/-nodelay tuning flags to a freshly
+// accepted or dialed TCP socket. It's a no-op for anything that isn't a
+// *net.TCPConn, so it's safe to call on any net.Conn.
+func configureConn(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetKeepAlive(*keepAlive)
+	if *keepAlive {
+		tc.SetKeepAlivePeriod(*keepAlivePeriod)
+	}
+	tc.SetNoDelay(*noDelay)
+}
+
+// setLingerZero marks the underlying TCP socket of a Tee's (or a plain
+// connection's) "a" side to RST on close instead of going through the
+// normal FIN/TIME_WAIT sequence. Used when the client disconnects first,
+// so we don't leave a's socket hanging around in TIME_WAIT for no reason.
+func setLingerZero(rw interface{ Close() error }) {
+	var a net.Conn
+	switch v := rw.(type) {
+	case *Tee:
+		a, _ = v.a.(net.Conn)
+	case net.Conn:
+		a = v
+	}
+	if tc, ok := a.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+}
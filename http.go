@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	httpMode     = flag.Bool("http", false, "speak HTTP/1.1 instead of raw TCP, so keep-alive and pipelined requests are handled correctly")
+	bHost        = flag.String("b-host", "", "override the Host header sent to b. defaults to the incoming request's Host")
+	aConcurrency = flag.Int("a-concurrency", 100, "max in-flight requests to a in -http mode")
+	bConcurrency = flag.Int("b-concurrency", 100, "max in-flight requests to b in -http mode")
+	diffLog      = flag.Bool("diff-log", false, "in -http mode, log a JSON line whenever a and b's responses diverge")
+)
+
+// aLimit and bLimit bound how many requests can be in flight to each
+// target at once, so a slow or stuck backend can't pile up goroutines.
+var aLimit, bLimit chan struct{}
+
+func initHTTPLimits() {
+	aLimit = make(chan struct{}, *aConcurrency)
+	bLimit = make(chan struct{}, *bConcurrency)
+}
+
+// divergence is what gets logged when a and b disagree about a response.
+type divergence struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	StatusA       int    `json:"status_a"`
+	StatusB       int    `json:"status_b"`
+	BodyHashA     string `json:"body_hash_a"`
+	BodyHashB     string `json:"body_hash_b"`
+	HeadersDiffer bool   `json:"headers_differ"`
+}
+
+// httpTee reads one or more HTTP/1.1 requests off conn, forwards each to
+// -a and a cloned copy to a weighted-selected b target, and writes a's
+// response back to the client. Unlike the raw TCP mode, this understands
+// request framing, so keep-alive connections and pipelined requests are
+// handled one request at a time instead of just splicing bytes.
+func httpTee(conn net.Conn, targets []*target) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(*timeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				debugLog("[DEBUG] http: reading request:", err)
+			}
+			return
+		}
+
+		if !serveHTTPRequest(conn, req, targets) {
+			return
+		}
+		if req.Close {
+			return
+		}
+	}
+}
+
+// serveHTTPRequest proxies a single request to a and b, streaming a's
+// response back to the client. It returns false if the connection should
+// be closed.
+func serveHTTPRequest(conn net.Conn, req *http.Request, targets []*target) bool {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		debugLog("[DEBUG] http: reading body:", err)
+		return false
+	}
+
+	var bSnap chan responseSnapshot
+	if *diffLog {
+		bSnap = make(chan responseSnapshot, 1)
+	}
+	go shadowToB(req, body, bSnap, targets)
+
+	// Bound how long a can hang us, so a wedged backend can't block the
+	// client forever or permanently occupy one of aLimit's slots.
+	aCtx, aCancel := context.WithTimeout(req.Context(), *timeout)
+	defer aCancel()
+
+	reqA := req.WithContext(aCtx)
+	urlA := *req.URL
+	reqA.URL = &urlA
+	reqA.Body = ioutil.NopCloser(bytes.NewReader(body))
+	reqA.RequestURI = ""
+	reqA.URL.Scheme = "http"
+	reqA.URL.Host = *targetProduction
+
+	aLimit <- struct{}{}
+	defer func() { <-aLimit }()
+
+	resp, err := http.DefaultTransport.RoundTrip(reqA)
+	if err != nil {
+		debugLog("[DEBUG] http: a round trip:", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// Only buffer a's whole body in memory when something's actually
+	// going to compare it; otherwise the response streams straight
+	// through to the client the way the doc comment promises.
+	var aBody bytes.Buffer
+	if *diffLog {
+		resp.Body = ioutil.NopCloser(io.TeeReader(resp.Body, &aBody))
+	}
+
+	if err := resp.Write(conn); err != nil {
+		debugLog("[DEBUG] http: writing response to client:", err)
+		return false
+	}
+
+	if *diffLog {
+		go compareResponses(req, resp.StatusCode, resp.Header, aBody.Bytes(), bSnap)
+	}
+
+	return true
+}
+
+// cloneRequest builds the shadow request sent to t: same method, path and
+// headers as req, replayed from the buffered body, and optionally with the
+// Host header overridden by -b-host.
+func cloneRequest(req *http.Request, body []byte, t *target) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.RequestURI = ""
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	clone.URL.Scheme = "http"
+	clone.URL.Host = t.addr
+	if *bHost != "" {
+		clone.Host = *bHost
+	}
+	return clone
+}
+
+// shadowToB picks a b target the same way the TCP path does, fires a clone
+// of req at it, and discards the response; b's response never reaches the
+// client. If snap is non-nil, the outcome is sent on it for
+// compareResponses to pick up. Bounded by *timeout so a wedged b can't hang
+// onto a bLimit slot forever.
+func shadowToB(req *http.Request, body []byte, snap chan<- responseSnapshot, targets []*target) {
+	bLimit <- struct{}{}
+	defer func() { <-bLimit }()
+
+	t := pickTarget(targets)
+	if t == nil {
+		debugLog("[DEBUG] http: no b target available")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), *timeout)
+	defer cancel()
+
+	resp, err := http.DefaultTransport.RoundTrip(cloneRequest(req.WithContext(ctx), body, t))
+	if err != nil {
+		t.breaker.recordFailure()
+		debugLog("[DEBUG] http: b round trip:", err)
+		return
+	}
+	defer resp.Body.Close()
+	t.breaker.recordSuccess()
+
+	// Only buffer b's body when something's actually going to compare it;
+	// otherwise just drain the socket so it can be closed/reused.
+	if snap == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		debugLog("[DEBUG] http: reading b body:", err)
+		return
+	}
+
+	snap <- responseSnapshot{status: resp.StatusCode, header: resp.Header, body: respBody}
+}
+
+// responseSnapshot carries b's outcome from shadowToB to compareResponses,
+// which is waiting on a's response and needs to pair the two up.
+type responseSnapshot struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// compareResponses waits for b's snapshot and logs a structured JSON line
+// if a and b disagree on status, headers, or body.
+func compareResponses(req *http.Request, statusA int, headerA http.Header, bodyA []byte, bSnap <-chan responseSnapshot) {
+	select {
+	case snap := <-bSnap:
+		hashA := sha256.Sum256(bodyA)
+		hashB := sha256.Sum256(snap.body)
+		if statusA == snap.status && hashA == hashB && headersEqual(headerA, snap.header) {
+			return
+		}
+		d := divergence{
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			StatusA:       statusA,
+			StatusB:       snap.status,
+			BodyHashA:     fmt.Sprintf("%x", hashA),
+			BodyHashB:     fmt.Sprintf("%x", hashB),
+			HeadersDiffer: !headersEqual(headerA, snap.header),
+		}
+		out, err := json.Marshal(d)
+		if err != nil {
+			return
+		}
+		fmt.Println(string(out))
+	case <-time.After(*timeout):
+		debugLog("[DEBUG] http: timed out waiting for b to compare")
+	}
+}
+
+// volatileHeaders are expected to differ between two independently-served,
+// content-identical responses, so they're ignored by headersEqual;
+// otherwise -diff-log would flag nearly every request as diverging.
+var volatileHeaders = map[string]bool{
+	"Date":            true,
+	"X-Request-Id":    true,
+	"X-Amzn-Trace-Id": true,
+	"Server-Timing":   true,
+}
+
+func headersEqual(a, b http.Header) bool {
+	af := stripVolatileHeaders(a)
+	bf := stripVolatileHeaders(b)
+	if len(af) != len(bf) {
+		return false
+	}
+	for k, va := range af {
+		vb, ok := bf[k]
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if va[i] != vb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripVolatileHeaders returns a copy of h with volatileHeaders removed.
+func stripVolatileHeaders(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		if !volatileHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+// Package metrics wires teeproxy's runtime behavior up to Prometheus so
+// operators can alert on it, instead of grepping debug logs for slow
+// requests. It's used from the accept loop, the tee/HandleTCP request
+// path, and Tee.Close.
+package metrics
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	ConnectionsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "teeproxy_connections_accepted_total",
+		Help: "Total number of client connections accepted.",
+	})
+
+	DialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "teeproxy_dial_duration_seconds",
+		Help: "Time spent dialing a target.",
+	}, []string{"target"})
+
+	DialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teeproxy_dial_errors_total",
+		Help: "Total number of failed dials to a target.",
+	}, []string{"target"})
+
+	BDrainOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teeproxy_b_drain_outcomes_total",
+		Help: "Outcome of draining b's socket in Tee.Close: drained or forced.",
+	}, []string{"outcome"})
+
+	BytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teeproxy_bytes_copied_total",
+		Help: "Total bytes copied, by direction.",
+	}, []string{"direction"})
+
+	RequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "teeproxy_request_duration_seconds",
+		Help:    "Total time to connect and proxy one connection end to end.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ConnectionsAccepted, DialDuration, DialErrors, BDrainOutcomes, BytesCopied, RequestDuration)
+}
+
+// Serve starts an HTTP server exposing /metrics in the Prometheus exposition
+// format. It blocks until the server stops, so callers typically run it in
+// its own goroutine.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// CopyAndCount is io.Copy that additionally records the number of bytes
+// copied under BytesCopied, labeled by direction (e.g. "client-to-backend").
+func CopyAndCount(dst io.Writer, src io.Reader, direction string) (int64, error) {
+	n, err := io.Copy(dst, src)
+	BytesCopied.WithLabelValues(direction).Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	breakerThreshold = flag.Int("b-breaker-threshold", 5, "consecutive failures of a b target (dial errors in TCP mode, round-trip errors in -http mode) before its circuit breaker trips")
+	breakerCooldown  = flag.Duration("b-breaker-cooldown", 10*time.Second, "how long a tripped b target's circuit breaker stays open before retrying")
+)
+
+// target is one weighted b backend. -b accepts a comma-separated list like
+// "canary1:8081=90,canary2:8081=10"; a target with no "=weight" gets weight 100.
+type target struct {
+	addr    string
+	weight  int
+	breaker *breaker
+}
+
+// parseTargets turns the -b flag value into a list of weighted targets.
+func parseTargets(s string) []*target {
+	parts := strings.Split(s, ",")
+	targets := make([]*target, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		addr, weight := p, 100
+		if i := strings.LastIndex(p, "="); i != -1 {
+			addr = p[:i]
+			if w, err := strconv.Atoi(p[i+1:]); err == nil {
+				weight = w
+			}
+		}
+		targets = append(targets, &target{addr: addr, weight: weight, breaker: &breaker{}})
+	}
+	return targets
+}
+
+// pickTarget selects one available target via weighted random sampling,
+// skipping any whose circuit breaker is currently open. It returns nil if
+// every target is unavailable. This picks a single target per connection
+// (weighted failover/load-splitting across connections) rather than
+// fanning any one connection out to every configured target.
+func pickTarget(targets []*target) *target {
+	total := 0
+	for _, t := range targets {
+		if t.breaker.allow() {
+			total += t.weight
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	r := rand.Intn(total)
+	for _, t := range targets {
+		if !t.breaker.allow() {
+			continue
+		}
+		if r < t.weight {
+			return t
+		}
+		r -= t.weight
+	}
+	return nil
+}
+
+// breaker is a simple consecutive-failure circuit breaker: once a target
+// fails breakerThreshold times in a row (a failed dial in TCP mode, a failed
+// round trip in -http mode), it's skipped for
+// breakerCooldown before being tried again.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil.IsZero() || time.Now().After(b.openUntil)
+}
+
+func (b *breaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *breaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= *breakerThreshold {
+		b.openUntil = time.Now().Add(*breakerCooldown)
+	}
+}
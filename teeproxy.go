@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,89 +10,189 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/mattrobenolt/teeproxy/metrics"
 )
 
 var (
 	listen           = flag.String("l", ":8888", "port to accept requests")
 	targetProduction = flag.String("a", "localhost:8080", "where production traffic goes. localhost:8080")
-	altTarget        = flag.String("b", "localhost:8081", "where testing traffic goes. response are skipped. localhost:8081")
+	altTarget        = flag.String("b", "localhost:8081", "where testing traffic goes. response are skipped. accepts a comma-separated list of weighted targets, e.g. \"canary1:8081=90,canary2:8081=10\" - one target is picked per connection by weighted random sampling, splitting traffic across targets rather than mirroring each connection to all of them")
 	linger           = flag.Duration("linger", 200*time.Millisecond, "time to finish reading from b before terminating connection")
 	debug            = flag.Bool("debug", false, "debug logging")
 	timeout          = flag.Duration("timeout", 1*time.Second, "total request timeout")
 	deadline         = flag.Duration("deadline", 100*time.Millisecond, "deadline to establish connections to b")
 	logThreshold     = flag.Duration("log-threshold", 500*time.Millisecond, "request duration before logging")
+	shutdownGrace    = flag.Duration("shutdown-grace", 10*time.Second, "how long to wait for in-flight connections to finish on SIGINT/SIGTERM before force-closing them")
+	metricsAddr      = flag.String("metrics", "", "if set, serve Prometheus metrics on this address, e.g. :9090")
+	maxShadowPumps   = flag.Int("max-shadow-pumps", 20000, "cap on total in-flight per-b pump goroutines across all connections, so a burst of connections can't OOM the process")
 )
 
 var ErrTimeout = errors.New("timeout")
 
-// a garbage buffer to accept all reads into from b
-var garbage = make([]byte, 64*1024)
+// teeSem bounds the total number of per-b pump goroutines (two per b: one
+// writing to it, one draining its reads) live at any moment. NewTee
+// acquires all the slots a Tee needs in a single Acquire call, blocking
+// once the cap is hit, which throttles new connections under a burst
+// instead of letting goroutines pile up unbounded. A single atomic
+// acquire (rather than one Acquire per slot) matters: two Tees each
+// grabbing half their slots and then blocking on the rest would deadlock
+// once the cap is exhausted, since nothing releases a slot until its pump
+// goroutine starts.
+var teeSem *semaphore.Weighted
+
+func initTeeSem() {
+	teeSem = semaphore.NewWeighted(int64(*maxShadowPumps))
+}
 
 type Tee struct {
-	a io.ReadWriteCloser
-	b io.ReadWriteCloser
-
-	// buffer writes coming in so they don't need to block
-	buf *bufio.Writer
-
-	closed bool
+	a  io.ReadWriteCloser
+	bs []io.ReadWriteCloser
+
+	// one buffered channel of pending writes per b, drained by that b's
+	// write pump goroutine so Write never blocks on a slow b
+	writeChs []chan []byte
+	// closed once each b's write pump has flushed everything and returned,
+	// so Close can wait for it to release its teeSem slot before t goes
+	// back to the pool
+	writeDone []chan struct{}
+	// closed once each b's read pump has stopped, so Close can tell a
+	// natural EOF from b apart from having to force it closed
+	readDone []chan struct{}
+
+	closed int32 // guarded with sync/atomic, see Close
+
+	// drained is closed once Close has finished tearing down every b, just
+	// before t is returned to teePool; after that nothing touches t's fields
+	// again until the next NewTee. Tests use it to wait out Close's background
+	// work instead of racing with it.
+	drained chan struct{}
 }
 
 // Provide the io.Writer interface to Tee
 func (t *Tee) Write(p []byte) (n int, err error) {
-	t.buf.Write(p)
-	go t.buf.Flush()
+	if len(t.writeChs) > 0 {
+		cp := append([]byte(nil), p...)
+		for _, ch := range t.writeChs {
+			select {
+			case ch <- cp:
+			default:
+				// that b's pump is behind; drop rather than block the
+				// client-facing path or grow an unbounded backlog
+				debugLog("[DEBUG] b write pump backed up, dropping chunk")
+			}
+		}
+	}
 	return t.a.Write(p)
 }
 
 // Provider the io.Reader interface to Tee
 func (t *Tee) Read(p []byte) (n int, err error) {
-	go t.b.Read(garbage[0:len(p)])
+	// b's sockets are drained continuously by their own read pumps
+	// started in NewTee, so there's nothing to do here but read from a.
 	return t.a.Read(p)
 }
 
+// writePump owns b's bufio.Writer for the life of the Tee. It's the only
+// goroutine that ever touches it, so unlike per-call Flush goroutines it
+// can't race with itself.
+func (t *Tee) writePump(b io.Writer, ch chan []byte, done chan struct{}) {
+	defer close(done)
+	defer teeSem.Release(1)
+	buf := bufio.NewWriter(b)
+	for p := range ch {
+		buf.Write(p)
+		buf.Flush()
+	}
+}
+
+// readPump drains b's socket into its own scratch buffer for the life of
+// the Tee, so b's kernel buffer never backs up. It exits once b is closed,
+// either because b hung up on its own or because Close forced it.
+func (t *Tee) readPump(b io.Reader, done chan struct{}) {
+	defer close(done)
+	defer teeSem.Release(1)
+	scratch := make([]byte, 32*1024)
+	io.CopyBuffer(ioutil.Discard, b, scratch)
+}
+
 // Provide the io.Closer interface to Tee
 func (t *Tee) Close() error {
 	// Allow to only be closed once
-	if t.closed {
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
 		return nil
 	}
-	t.closed = true
 
-	// At this point, we need to lazily close the "b" connection
-	// Meaning, we want to make a best effort to drain it's reads
-	// before hard closing. This will prevent the "b" side of the pipe
+	// Stop accepting new writes; each write pump flushes and exits once
+	// its channel is drained and closed.
+	for _, ch := range t.writeChs {
+		close(ch)
+	}
+
+	// At this point, we need to lazily close the "b" connections
+	// Meaning, we want to make a best effort to drain their reads
+	// before hard closing. This will prevent the "b" side of the pipes
 	// from getting pipes closed unexpectedly
 	// BUT we also don't want to wait around forever
-	go func() {
-		debugLog("[DEBUG] lingering for b to disconnect")
-
-		// Start the final drain of the socket
-		c := make(chan struct{}, 1)
-		go func() {
-			io.Copy(ioutil.Discard, t.b)
-			c <- struct{}{}
-		}()
-		select {
-		case <-c:
-			// Drain finished, and the backend closed the socket
-			debugLog("[DEBUG] b closed connection")
-		case <-time.After(*linger):
-			// We waited too long, forcibly close this shit
-			debugLog("[DEBUG] forcing b closed")
-		}
-		debugLog("[DEBUG] finished draining tee")
+	var wg sync.WaitGroup
+	wg.Add(2 * len(t.bs))
+	for i, b := range t.bs {
+		// The write pump has nothing left to flush once its channel is
+		// closed above, so it should return almost immediately; bound the
+		// wait by *linger anyway so a b that's stopped accepting writes
+		// can't hold this Tee (and its teeSem slot) forever.
+		go func(done chan struct{}) {
+			defer wg.Done()
+			select {
+			case <-done:
+			case <-time.After(*linger):
+				debugLog("[DEBUG] write pump still flushing to b after linger, abandoning wait")
+			}
+		}(t.writeDone[i])
+
+		go func(b io.ReadWriteCloser, done chan struct{}) {
+			defer wg.Done()
+			debugLog("[DEBUG] lingering for b to disconnect")
+
+			select {
+			case <-done:
+				// Drain finished, and the backend closed the socket
+				debugLog("[DEBUG] b closed connection")
+				metrics.BDrainOutcomes.WithLabelValues("drained").Inc()
+			case <-time.After(*linger):
+				// We waited too long, forcibly close this shit
+				debugLog("[DEBUG] forcing b closed")
+				metrics.BDrainOutcomes.WithLabelValues("forced").Inc()
+			}
 
-		// Close the socket
-		t.b.Close()
+			// Close the socket, then wait for its read pump to notice and
+			// release its slot before we consider this b fully torn down.
+			b.Close()
+			<-done
+			debugLog("[DEBUG] finished draining tee")
+		}(b, t.readDone[i])
+	}
+	// Forcibly close our "a" pipe when client disconnects. This must
+	// finish before t goes back to the pool: otherwise a concurrent
+	// NewTee() could Get() this *Tee and overwrite t.a while this Close
+	// call is still reading it.
+	err := t.a.Close()
+	go func() {
+		wg.Wait()
+		close(t.drained)
 		// Release Tee back to it's pool for reuse
 		teePool.Put(t)
 	}()
-	// Forcibly close our "a" pipe when client disconnects
-	return t.a.Close()
+	return err
 }
 
 var teePool = &sync.Pool{
@@ -101,12 +202,37 @@ var teePool = &sync.Pool{
 	},
 }
 
-func NewTee(a, b io.ReadWriteCloser) io.ReadWriteCloser {
+// NewTee wires a up to be mirrored to every connection in bs. Every caller
+// today passes a single weighted-selected target (see pickTarget), so -b's
+// fan-out is one target per connection, not simultaneous mirroring to
+// several; bs stays a slice so that could grow without changing this API.
+// Each b gets its own write pump and read pump goroutine for the life of
+// the Tee, bounded by teeSem so a connection burst can't spawn unbounded
+// goroutines.
+func NewTee(a io.ReadWriteCloser, bs []io.ReadWriteCloser) io.ReadWriteCloser {
+	// Acquire every slot this Tee needs in one call, not one Acquire per
+	// slot: acquiring piecemeal lets two Tees each grab half their slots
+	// and then block on the rest forever once the cap is exhausted.
+	teeSem.Acquire(context.Background(), int64(2*len(bs)))
+
 	t := teePool.Get().(*Tee)
-	t.closed = false
+	t.closed = 0
 	t.a = a
-	t.b = b
-	t.buf = bufio.NewWriter(b)
+	t.bs = bs
+	t.writeChs = make([]chan []byte, len(bs))
+	t.writeDone = make([]chan struct{}, len(bs))
+	t.readDone = make([]chan struct{}, len(bs))
+	t.drained = make(chan struct{})
+	for i, b := range bs {
+		ch := make(chan []byte, 64)
+		writeDone := make(chan struct{})
+		readDone := make(chan struct{})
+		t.writeChs[i] = ch
+		t.writeDone[i] = writeDone
+		t.readDone[i] = readDone
+		go t.writePump(b, ch, writeDone)
+		go t.readPump(b, readDone)
+	}
 	return t
 }
 
@@ -121,9 +247,12 @@ func HandleTCP(conn, out io.ReadWriteCloser) {
 	c := make(chan struct{}, 0)
 	go func() {
 		go func() {
-			io.Copy(out, conn)
+			metrics.CopyAndCount(out, conn, "client-to-backend")
 			// client got an error or EOF, so disconnect
 			conn.Close()
+			if *lingerZero {
+				setLingerZero(out)
+			}
 			out.Close()
 			debugLog("[DEBUG] client disconnected")
 			wg.Done()
@@ -131,7 +260,7 @@ func HandleTCP(conn, out io.ReadWriteCloser) {
 
 		// Copy bytes from server(s) and write to client
 		go func() {
-			io.Copy(conn, out)
+			metrics.CopyAndCount(conn, out, "backend-to-client")
 			// server got an error or EOF, so disconnect
 			out.Close()
 			conn.Close()
@@ -163,7 +292,7 @@ func debugLog(a ...interface{}) {
 	log.Println(a...)
 }
 
-func TeeConnectTimeout(conn net.Conn, targetAddr, altAddr string) (out io.ReadWriteCloser, err error) {
+func TeeConnectTimeout(conn net.Conn, targetAddr string, targets []*target) (out io.ReadWriteCloser, err error) {
 	start := time.Now()
 	defer func() {
 		debugLog("[DEBUG] connect time", time.Now().Sub(start))
@@ -171,21 +300,37 @@ func TeeConnectTimeout(conn net.Conn, targetAddr, altAddr string) (out io.ReadWr
 
 	starta := time.Now()
 	// Establish our connection to "a" socket
-	out, err = net.DialTimeout("tcp", targetAddr, 500*time.Second)
+	var aConn net.Conn
+	aConn, err = net.DialTimeout("tcp", targetAddr, 500*time.Second)
+	metrics.DialDuration.WithLabelValues("a").Observe(time.Since(starta).Seconds())
 	debugLog("[DEBUG] connect to a", time.Now().Sub(starta))
 	if err != nil {
+		metrics.DialErrors.WithLabelValues("a").Inc()
 		log.Println("[ERROR] Could not connect to 'a', closing.", err)
 		// if we can't even connect to a, there's no point in continuing
 		return
 	}
+	configureConn(aConn)
+	out = aConn
+
+	t := pickTarget(targets)
+	if t == nil {
+		log.Println("[ERROR] No 'b' target available, ignoring.")
+		return
+	}
 
 	var b net.Conn
 	startb := time.Now()
-	b, err = net.DialTimeout("tcp", altAddr, *deadline)
-	debugLog("[DEBUG] connect to b", time.Now().Sub(startb))
+	b, err = net.DialTimeout("tcp", t.addr, *deadline)
+	metrics.DialDuration.WithLabelValues(t.addr).Observe(time.Since(startb).Seconds())
+	debugLog("[DEBUG] connect to b", t.addr, time.Now().Sub(startb))
 	if err == nil {
-		out = NewTee(out, b)
+		configureConn(b)
+		t.breaker.recordSuccess()
+		out = NewTee(out, []io.ReadWriteCloser{b})
 	} else {
+		t.breaker.recordFailure()
+		metrics.DialErrors.WithLabelValues(t.addr).Inc()
 		log.Println("[ERROR] Could not connect to 'b', ignoring.", err)
 		// we can't connect to b, but it doesn't really matter
 		err = nil
@@ -193,12 +338,12 @@ func TeeConnectTimeout(conn net.Conn, targetAddr, altAddr string) (out io.ReadWr
 	return
 }
 
-func tee(conn net.Conn, targetAddr, altAddr string) {
+func tee(conn net.Conn, targetAddr string, targets []*target) {
 	// log.Println(fmt.Sprintf("[INFO] new connection %s", conn.RemoteAddr()))
 	start := time.Now()
 
 	starta := time.Now()
-	out, err := TeeConnectTimeout(conn, targetAddr, altAddr)
+	out, err := TeeConnectTimeout(conn, targetAddr, targets)
 	enda := time.Now()
 	if err != nil {
 		log.Println("[ERROR] Couldn't establish connection to upstream!", err)
@@ -211,6 +356,7 @@ func tee(conn net.Conn, targetAddr, altAddr string) {
 	endb := time.Now()
 
 	end := time.Now()
+	metrics.RequestDuration.Observe(end.Sub(start).Seconds())
 
 	// Log any request that took longer than our threshold
 	if end.Sub(start) > *logThreshold {
@@ -222,6 +368,9 @@ func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	targets := parseTargets(*altTarget)
+	initTeeSem()
+
 	fmt.Println("teeproxy")
 	fmt.Println("listen:", *listen)
 	fmt.Println("a:", *targetProduction)
@@ -230,24 +379,85 @@ func main() {
 	fmt.Println("linger:", *linger)
 	fmt.Println("log-threshold:", *logThreshold)
 
-	ln, err := net.Listen("tcp", *listen)
+	if *httpMode {
+		initHTTPLimits()
+		fmt.Println("mode: http")
+	} else {
+		fmt.Println("mode: tcp")
+	}
+
+	if *metricsAddr != "" {
+		fmt.Println("metrics:", *metricsAddr)
+		go func() {
+			log.Fatal(metrics.Serve(*metricsAddr))
+		}()
+	}
+
+	rawLn, err := net.Listen("tcp", *listen)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ln := rawLn.(*net.TCPListener)
+
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		log.Println("[INFO] received", s, "shutting down")
+		close(shutdown)
+	}()
+
+	var wg sync.WaitGroup
 
 	// dat concurrent Accept
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go func() {
 			for {
+				// Wake up periodically to notice shutdown even with no traffic
+				ln.SetDeadline(time.Now().Add(time.Second))
 				conn, err := ln.Accept()
 				if err != nil {
+					select {
+					case <-shutdown:
+						return
+					default:
+					}
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						continue
+					}
 					log.Println(err)
 					continue
 				}
-				go tee(conn, *targetProduction, *altTarget)
+				configureConn(conn)
+				metrics.ConnectionsAccepted.Inc()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if *httpMode {
+						httpTee(conn, targets)
+					} else {
+						tee(conn, *targetProduction, targets)
+					}
+				}()
 			}
 		}()
 	}
 
-	select {}
+	<-shutdown
+	ln.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("[INFO] all connections drained")
+	case <-time.After(*shutdownGrace):
+		log.Println("[INFO] shutdown grace period expired, forcing exit")
+	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTeeConcurrentOpenClose stresses NewTee/Tee.Close with thousands of
+// simultaneous connections opening and closing rapidly, modeled on the
+// classic concurrent-map-crash scenario. Run with -race: it should catch
+// the old per-op Flush/Read goroutines and the unsynchronized closed
+// field racing with each other.
+func TestTeeConcurrentOpenClose(t *testing.T) {
+	initTeeSem()
+	old := *linger
+	*linger = 5 * time.Millisecond
+	defer func() { *linger = old }()
+
+	const n = 2000
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			a1, a2 := net.Pipe()
+			b1, b2 := net.Pipe()
+			defer a2.Close()
+			defer b2.Close()
+
+			go io.Copy(ioutil.Discard, a2)
+			go io.Copy(ioutil.Discard, b2)
+
+			tee := NewTee(a1, []io.ReadWriteCloser{b1}).(*Tee)
+
+			var readWg sync.WaitGroup
+			readWg.Add(1)
+			go func() {
+				defer readWg.Done()
+				buf := make([]byte, 5)
+				tee.Read(buf)
+			}()
+
+			tee.Write([]byte("hello"))
+			a2.Write([]byte("world"))
+			readWg.Wait()
+
+			// Grab the drained channel before Close: once Close finishes,
+			// tee can be reused by another NewTee, which would overwrite
+			// this field out from under us.
+			drained := tee.drained
+			tee.Close()
+			// Wait for Close's background drain/pool-release goroutine to
+			// fully finish before this connection's pipes get closed and
+			// the shared *linger flag gets restored, so we don't race with
+			// Close's own goroutines still reading it.
+			<-drained
+		}()
+	}
+	wg.Wait()
+}
+
+// TestTeeConcurrentOpenCloseBoundedPumps is TestTeeConcurrentOpenClose with
+// *maxShadowPumps set low enough, relative to the connection count, that
+// NewTee's calls actually contend on teeSem instead of always finding a
+// free slot. This is the scenario teeSem exists for: without an atomic
+// Acquire of all the slots a Tee needs, two Tees each grabbing half their
+// slots and then blocking on the rest deadlocks once the cap is exhausted.
+func TestTeeConcurrentOpenCloseBoundedPumps(t *testing.T) {
+	oldPumps := *maxShadowPumps
+	*maxShadowPumps = 8 // room for 4 concurrent Tees (2 slots each)
+	defer func() { *maxShadowPumps = oldPumps }()
+	initTeeSem()
+
+	old := *linger
+	*linger = 5 * time.Millisecond
+	defer func() { *linger = old }()
+
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			a1, a2 := net.Pipe()
+			b1, b2 := net.Pipe()
+			defer a2.Close()
+			defer b2.Close()
+
+			go io.Copy(ioutil.Discard, a2)
+			go io.Copy(ioutil.Discard, b2)
+
+			tee := NewTee(a1, []io.ReadWriteCloser{b1}).(*Tee)
+
+			var readWg sync.WaitGroup
+			readWg.Add(1)
+			go func() {
+				defer readWg.Done()
+				buf := make([]byte, 5)
+				tee.Read(buf)
+			}()
+
+			tee.Write([]byte("hello"))
+			a2.Write([]byte("world"))
+			readWg.Wait()
+
+			drained := tee.drained
+			tee.Close()
+			<-drained
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for connections to finish; teeSem likely deadlocked")
+	}
+}